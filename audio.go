@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// minAudioBitrate is the floor we'll accept when picking the lowest-bitrate
+// opus track for PCM extraction; anything below this tends to be too lossy
+// for waveform/DSP work.
+const minAudioBitrate = 64_000
+
+// findBestPCMAudioFormat picks the audio-only format best suited to PCM
+// extraction: opus-encoded, stereo preferred, and the lowest bitrate that
+// still clears minAudioBitrate (rather than the highest bitrate available,
+// since raw PCM callers care about channel layout more than source bitrate).
+func findBestPCMAudioFormat(formats youtube.FormatList) *youtube.Format {
+	var best *youtube.Format
+
+	betterThan := func(candidate, current *youtube.Format) bool {
+		if current == nil {
+			return true
+		}
+		candidateStereo := candidate.AudioChannels == 2
+		currentStereo := current.AudioChannels == 2
+		if candidateStereo != currentStereo {
+			return candidateStereo
+		}
+		candidateMeets := candidate.Bitrate >= minAudioBitrate
+		currentMeets := current.Bitrate >= minAudioBitrate
+		if candidateMeets != currentMeets {
+			return candidateMeets
+		}
+		if candidateMeets && currentMeets {
+			return candidate.Bitrate < current.Bitrate
+		}
+		return candidate.Bitrate > current.Bitrate
+	}
+
+	for i := range formats {
+		format := &formats[i]
+		if !strings.Contains(format.MimeType, "audio") {
+			continue
+		}
+		if !strings.Contains(format.MimeType, "opus") && !strings.Contains(format.MimeType, "webm") {
+			continue
+		}
+		if betterThan(format, best) {
+			best = format
+		}
+	}
+
+	if best == nil {
+		// Fall back to any audio track if nothing opus/webm-tagged is offered.
+		best = findBestAudioFormat(formats)
+	}
+
+	return best
+}
+
+// processAudioOnly resolves the video, selects the best PCM-suitable audio
+// track, and streams the decoded raw samples to w without ever touching the
+// video download goroutine or the ffmpeg merge step used by processDownload.
+func processAudioOnly(ctx context.Context, w http.ResponseWriter, url string, sampleRate int, channels int) error {
+	client := youtube.Client{HTTPClient: httpClient}
+
+	video, err := client.GetVideoContext(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to get video info: %w", err)
+	}
+
+	bestAudio := findBestPCMAudioFormat(video.Formats)
+	if bestAudio == nil {
+		return fmt.Errorf("could not find a suitable audio format")
+	}
+
+	log.Printf("[INFO] Extracting PCM audio from: %s (itag %d, %d bps)", video.Title, bestAudio.ItagNo, bestAudio.Bitrate)
+
+	stream, _, err := client.GetStreamContext(ctx, video, bestAudio)
+	if err != nil {
+		return fmt.Errorf("failed to open audio stream: %w", err)
+	}
+	defer stream.Close()
+
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("ffmpeg not found in PATH")
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-i", "pipe:0",
+		"-vn",
+		"-acodec", "pcm_s16le",
+		"-f", "s16le",
+		"-ar", strconv.Itoa(sampleRate),
+		"-ac", strconv.Itoa(channels),
+		"pipe:1",
+	)
+	cmd.Stdin = stream
+	cmd.Stdout = w
+
+	w.Header().Set("Content-Type", "audio/L16")
+	w.Header().Set("X-Sample-Rate", strconv.Itoa(sampleRate))
+	w.Header().Set("X-Channels", strconv.Itoa(channels))
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg pcm extraction failed: %w", err)
+	}
+
+	return nil
+}
+
+func audioDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "Missing required parameter: url", http.StatusBadRequest)
+		metrics.RecordDownload(false, 0)
+		return
+	}
+
+	sampleRate := 48000
+	if sr := r.URL.Query().Get("sample_rate"); sr != "" {
+		if parsed, err := strconv.Atoi(sr); err == nil && parsed > 0 {
+			sampleRate = parsed
+		}
+	}
+
+	channels := 2
+	if r.URL.Query().Get("format") != "" && r.URL.Query().Get("format") != "s16le" {
+		http.Error(w, "Unsupported format, only s16le is supported", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case downloadSemaphore <- struct{}{}:
+		defer func() { <-downloadSemaphore }()
+	case <-time.After(30 * time.Second):
+		http.Error(w, "Server too busy, try again later", http.StatusServiceUnavailable)
+		metrics.RecordDownload(false, 0)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.DownloadTimeout)
+	defer cancel()
+
+	if err := processAudioOnly(ctx, w, url, sampleRate, channels); err != nil {
+		log.Printf("[ERROR] Audio extraction failed: %v", err)
+		http.Error(w, fmt.Sprintf("Audio extraction failed: %v", err), http.StatusInternalServerError)
+		metrics.RecordDownload(false, 0)
+		return
+	}
+
+	metrics.RecordDownload(true, 0)
+}
@@ -33,6 +33,10 @@ func getTmpfsUsage() (totalMB, usedMB, availableMB float64, usagePercent float64
 }
 
 func checkDiskSpace(requiredBytes int64) error {
+	if !storage.UsesLocalDisk() {
+		return nil // S3 mode skips this check, though downloads still stage on tmpfs
+	}
+
 	var stat unix.Statfs_t
 	if err := unix.Statfs(config.TempDir, &stat); err != nil {
 		return fmt.Errorf("failed to check disk space: %w", err)
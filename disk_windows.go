@@ -29,6 +29,10 @@ func getTmpfsUsage() (totalMB, usedMB, availableMB float64, usagePercent float64
 }
 
 func checkDiskSpace(requiredBytes int64) error {
+	if !storage.UsesLocalDisk() {
+		return nil // S3 mode skips this check, though downloads still stage on tmpfs
+	}
+
 	_, available := getDiskSpaceWindows(config.TempDir)
 
 	if available < requiredBytes {
@@ -0,0 +1,186 @@
+// Package ippool manages a rotating set of outbound source IPs so
+// downloads can be spread across them to mitigate per-IP throttling from
+// the YouTube edge (HTTP 429/403 responses).
+package ippool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IPState is a point-in-time snapshot of one pool member, suitable for
+// serializing at a status endpoint.
+type IPState struct {
+	IP             string    `json:"ip"`
+	InUse          bool      `json:"in_use"`
+	Throttled      bool      `json:"throttled"`
+	ThrottledUntil time.Time `json:"throttled_until,omitempty"`
+	TotalRents     int64     `json:"total_rents"`
+	ThrottleEvents int64     `json:"throttle_events"`
+}
+
+type member struct {
+	ip             string
+	inUse          bool
+	throttledUntil time.Time
+	totalRents     int64
+	throttleEvents int64
+}
+
+// Pool hands out source IPs round-robin, skipping any currently under a
+// throttle cooldown.
+type Pool struct {
+	mutex   sync.Mutex
+	members []*member
+	next    int
+}
+
+// New builds a pool from an explicit list of source IPs.
+func New(ips []string) *Pool {
+	p := &Pool{}
+	for _, ip := range ips {
+		p.members = append(p.members, &member{ip: ip})
+	}
+	return p
+}
+
+// Discover builds a pool from the machine's own non-loopback IPv4
+// addresses, for deployments that don't set SOURCE_IPS explicitly.
+func Discover() (*Pool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to enumerate interface addresses: %w", err)
+	}
+
+	var ips []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			ips = append(ips, ip4.String())
+		}
+	}
+
+	return New(ips), nil
+}
+
+// Lease is a rented IP; callers must call Release when done with it.
+type Lease struct {
+	IP   string
+	pool *Pool
+}
+
+// Release returns the leased IP to the pool so it can be rented again.
+func (l *Lease) Release() {
+	l.pool.release(l.IP)
+}
+
+// Transport builds an http.Transport whose outbound connections are bound
+// to this lease's IP via a custom DialContext.
+func (l *Lease) Transport() *http.Transport {
+	return l.pool.transportFor(l.IP)
+}
+
+// Rent returns the next non-throttled, non-in-use IP in round-robin order,
+// starting after the last one rented. If every member is currently throttled or in use, it returns an
+// error rather than blocking the caller.
+func (p *Pool) Rent() (*Lease, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.members) == 0 {
+		return nil, fmt.Errorf("ip pool is empty")
+	}
+
+	now := time.Now()
+	for i := 0; i < len(p.members); i++ {
+		idx := (p.next + i) % len(p.members)
+		m := p.members[idx]
+		if m.inUse || now.Before(m.throttledUntil) {
+			continue
+		}
+
+		m.inUse = true
+		m.totalRents++
+		p.next = (idx + 1) % len(p.members)
+		return &Lease{IP: m.ip, pool: p}, nil
+	}
+
+	return nil, fmt.Errorf("no available source ip: all %d members are throttled or in use", len(p.members))
+}
+
+func (p *Pool) release(ip string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, m := range p.members {
+		if m.ip == ip {
+			m.inUse = false
+			return
+		}
+	}
+}
+
+// Throttle marks ip as unusable for the next d, typically called after
+// observing a 429/403 response while using it.
+func (p *Pool) Throttle(ip string, d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, m := range p.members {
+		if m.ip == ip {
+			m.throttledUntil = time.Now().Add(d)
+			m.throttleEvents++
+			return
+		}
+	}
+}
+
+func (p *Pool) transportFor(ip string) *http.Transport {
+	localAddr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	dialer := &net.Dialer{LocalAddr: localAddr, Timeout: 30 * time.Second}
+
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		MaxIdleConns:        10,
+		IdleConnTimeout:     30 * time.Second,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 10,
+	}
+}
+
+// Snapshot reports the current state of every pool member, for exposing at
+// a status endpoint.
+func (p *Pool) Snapshot() []IPState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	states := make([]IPState, 0, len(p.members))
+	now := time.Now()
+	for _, m := range p.members {
+		states = append(states, IPState{
+			IP:             m.ip,
+			InUse:          m.inUse,
+			Throttled:      now.Before(m.throttledUntil),
+			ThrottledUntil: m.throttledUntil,
+			TotalRents:     m.totalRents,
+			ThrottleEvents: m.throttleEvents,
+		})
+	}
+	return states
+}
+
+// Len reports how many IPs are configured in the pool.
+func (p *Pool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.members)
+}
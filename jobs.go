@@ -0,0 +1,574 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+const jobsBucket = "jobs"
+
+// videoJobStatus tracks one video's progress within a playlist/channel job.
+type videoJobStatus string
+
+const (
+	videoQueued      videoJobStatus = "queued"
+	videoDownloading videoJobStatus = "downloading"
+	videoMerging     videoJobStatus = "merging"
+	videoDone        videoJobStatus = "done"
+	videoFailed      videoJobStatus = "failed"
+)
+
+type videoJob struct {
+	VideoID     string         `json:"video_id"`
+	Title       string         `json:"title"`
+	Status      videoJobStatus `json:"status"`
+	OutputFile  string         `json:"output_file,omitempty"`
+	DownloadURL string         `json:"download_url,omitempty"`
+	SizeBytes   int64          `json:"size_bytes,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+type batchJobStatus string
+
+const (
+	batchRunning batchJobStatus = "running"
+	batchDone    batchJobStatus = "done"
+	batchFailed  batchJobStatus = "failed"
+)
+
+// batchJob is a playlist or channel download expanded into per-video jobs.
+type batchJob struct {
+	ID        string         `json:"id"`
+	SourceURL string         `json:"source_url"`
+	Kind      string         `json:"kind"` // "playlist" | "channel"
+	Status    batchJobStatus `json:"status"`
+	Videos    []*videoJob    `json:"videos"`
+	ZipFile   string         `json:"zip_file,omitempty"`
+	ZipURL    string         `json:"zip_url,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	mutex     sync.Mutex
+}
+
+// jobStore persists batchJobs in a BoltDB file so job status survives a
+// server restart while a batch is still running.
+type jobStore struct {
+	db *bolt.DB
+}
+
+var jobs *jobStore
+
+func initJobStore() error {
+	dbPath := filepath.Join(config.TempDir, "jobs.db")
+	db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open job store: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(jobsBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to initialize job store bucket: %w", err)
+	}
+
+	jobs = &jobStore{db: db}
+	return nil
+}
+
+func (s *jobStore) save(job *batchJob) error {
+	job.mutex.Lock()
+	data, err := json.Marshal(job)
+	job.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jobsBucket)).Put([]byte(job.ID), data)
+	})
+}
+
+func (s *jobStore) load(id string) (*batchJob, error) {
+	var job batchJob
+	found := false
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(jobsBucket)).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+// reapExpired deletes every job older than ttl (and its batch_<id> output
+// directory, including the finished MP4s and zip) from the store. Batch
+// output is exempted from the regular MaxFileAge tmpfs sweep precisely so
+// it survives until a job's own retention window, not the generic one;
+// this is what actually retires it.
+func (s *jobStore) reapExpired(ttl time.Duration) {
+	var expired []string
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jobsBucket)).ForEach(func(id, data []byte) error {
+			var job batchJob
+			if err := json.Unmarshal(data, &job); err != nil {
+				return nil
+			}
+			if time.Since(job.CreatedAt) > ttl {
+				expired = append(expired, string(id))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to scan job store for expired jobs: %v", err)
+		return
+	}
+
+	for _, id := range expired {
+		os.RemoveAll(filepath.Join(config.TempDir, "batch_"+id))
+
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(jobsBucket)).Delete([]byte(id))
+		})
+		if err != nil {
+			log.Printf("[WARN] Failed to delete expired job %s: %v", id, err)
+			continue
+		}
+		log.Printf("[INFO] Reaped expired job %s (older than %v)", id, ttl)
+	}
+}
+
+// runBatchJob downloads every video in job one at a time, respecting the
+// existing downloadSemaphore so playlist/channel jobs compete fairly with
+// single-video downloads for ffmpeg/bandwidth capacity.
+func runBatchJob(job *batchJob) {
+	client := youtube.Client{HTTPClient: httpClient}
+	outDir := filepath.Join(config.TempDir, "batch_"+job.ID)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		log.Printf("[ERROR] Batch job %s: failed to create output dir: %v", job.ID, err)
+		job.mutex.Lock()
+		job.Status = batchFailed
+		job.mutex.Unlock()
+		jobs.save(job)
+		return
+	}
+
+	for _, vj := range job.Videos {
+		downloadSemaphore <- struct{}{}
+		runOneBatchVideo(&client, job, vj, outDir)
+		<-downloadSemaphore
+		jobs.save(job)
+	}
+
+	job.mutex.Lock()
+	failures := 0
+	for _, vj := range job.Videos {
+		if vj.Status == videoFailed {
+			failures++
+		}
+	}
+	if failures == len(job.Videos) && len(job.Videos) > 0 {
+		job.Status = batchFailed
+	} else {
+		job.Status = batchDone
+	}
+	job.mutex.Unlock()
+
+	if zipPath, err := zipBatchResults(job, outDir); err != nil {
+		log.Printf("[WARN] Batch job %s: failed to zip results: %v", job.ID, err)
+	} else {
+		job.mutex.Lock()
+		job.ZipFile = zipPath
+		job.mutex.Unlock()
+	}
+
+	jobs.save(job)
+	log.Printf("[INFO] Batch job %s finished: %s", job.ID, job.Status)
+}
+
+func runOneBatchVideo(client *youtube.Client, job *batchJob, vj *videoJob, outDir string) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.DownloadTimeout)
+	defer cancel()
+
+	setVideoStatus(job, vj, videoDownloading, "")
+
+	video, err := client.GetVideoContext(ctx, vj.VideoID)
+	if err != nil {
+		setVideoStatus(job, vj, videoFailed, err.Error())
+		return
+	}
+	vj.Title = video.Title
+
+	bestVideo := findBestVideoFormat(video.Formats)
+	bestAudio := findBestAudioFormat(video.Formats)
+	if bestVideo == nil || bestAudio == nil {
+		setVideoStatus(job, vj, videoFailed, "could not find required video/audio formats")
+		return
+	}
+
+	videoFile := filepath.Join(outDir, vj.VideoID+"_video.tmp")
+	audioFile := filepath.Join(outDir, vj.VideoID+"_audio.tmp")
+	outputFile := filepath.Join(outDir, sanitizeFilename(video.Title)+".mp4")
+
+	var wg sync.WaitGroup
+	var videoErr, audioErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		videoErr = downloadStream(ctx, client, video, bestVideo, videoFile)
+	}()
+	go func() {
+		defer wg.Done()
+		audioErr = downloadStream(ctx, client, video, bestAudio, audioFile)
+	}()
+	wg.Wait()
+	defer cleanupFiles(videoFile, audioFile)
+
+	if videoErr != nil {
+		setVideoStatus(job, vj, videoFailed, videoErr.Error())
+		return
+	}
+	if audioErr != nil {
+		setVideoStatus(job, vj, videoFailed, audioErr.Error())
+		return
+	}
+
+	setVideoStatus(job, vj, videoMerging, "")
+	if err := mergeStreams(ctx, videoFile, audioFile, outputFile); err != nil {
+		setVideoStatus(job, vj, videoFailed, err.Error())
+		return
+	}
+
+	job.mutex.Lock()
+	vj.OutputFile = outputFile
+	if stat, err := os.Stat(outputFile); err == nil {
+		vj.SizeBytes = stat.Size()
+	}
+	vj.Status = videoDone
+	job.mutex.Unlock()
+}
+
+func setVideoStatus(job *batchJob, vj *videoJob, status videoJobStatus, errMsg string) {
+	job.mutex.Lock()
+	vj.Status = status
+	vj.Error = errMsg
+	job.mutex.Unlock()
+}
+
+// zipBatchResults packages every finished video in outDir into a single
+// archive, so /jobs/{id} can hand back one download instead of N.
+func zipBatchResults(job *batchJob, outDir string) (string, error) {
+	zipPath := filepath.Join(outDir, job.ID+".zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		return "", err
+	}
+	defer zipFile.Close()
+
+	zw := zip.NewWriter(zipFile)
+	defer zw.Close()
+
+	for _, vj := range job.Videos {
+		if vj.Status != videoDone || vj.OutputFile == "" {
+			continue
+		}
+		if err := addFileToZip(zw, vj.OutputFile); err != nil {
+			return "", err
+		}
+	}
+
+	return zipPath, nil
+}
+
+func addFileToZip(zw *zip.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := zw.Create(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// resolveChannelUploadsPlaylist turns a channel URL or UC-prefixed channel
+// ID into its uploads playlist ID (YouTube mirrors every channel's uploads
+// under a UU-prefixed playlist with the same suffix as the channel ID).
+func resolveChannelUploadsPlaylist(channel string) (string, error) {
+	id := channel
+	if idx := strings.LastIndex(channel, "/channel/"); idx != -1 {
+		id = channel[idx+len("/channel/"):]
+	}
+	id = strings.TrimSuffix(id, "/")
+
+	if !strings.HasPrefix(id, "UC") {
+		return "", fmt.Errorf("only /channel/UC... URLs are supported (custom/@handle URLs need channel ID resolution)")
+	}
+
+	return "UU" + strings.TrimPrefix(id, "UC"), nil
+}
+
+func newBatchJob(sourceURL, kind string, videoIDs []string) *batchJob {
+	id := fmt.Sprintf("%d", time.Now().UnixNano())
+
+	videos := make([]*videoJob, 0, len(videoIDs))
+	for _, vid := range videoIDs {
+		videos = append(videos, &videoJob{VideoID: vid, Status: videoQueued})
+	}
+
+	return &batchJob{
+		ID:        id,
+		SourceURL: sourceURL,
+		Kind:      kind,
+		Status:    batchRunning,
+		Videos:    videos,
+		CreatedAt: time.Now(),
+	}
+}
+
+func startBatchDownload(w http.ResponseWriter, sourceURL, kind string, videoIDs []string) {
+	if len(videoIDs) > config.MaxPlaylistSize {
+		log.Printf("[WARN] %s %s has %d videos, truncating to MaxPlaylistSize=%d", kind, sourceURL, len(videoIDs), config.MaxPlaylistSize)
+		videoIDs = videoIDs[:config.MaxPlaylistSize]
+	}
+
+	job := newBatchJob(sourceURL, kind, videoIDs)
+	if err := jobs.save(job); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to persist job: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	go runBatchJob(job)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"job_id": job.ID})
+}
+
+func playlistDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "Missing required parameter: url", http.StatusBadRequest)
+		return
+	}
+
+	client := youtube.Client{HTTPClient: httpClient}
+	playlist, err := client.GetPlaylistContext(r.Context(), url)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load playlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	videoIDs := make([]string, 0, len(playlist.Videos))
+	for _, entry := range playlist.Videos {
+		videoIDs = append(videoIDs, entry.ID)
+	}
+
+	startBatchDownload(w, url, "playlist", videoIDs)
+}
+
+func channelDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "Missing required parameter: url", http.StatusBadRequest)
+		return
+	}
+
+	uploadsPlaylistID, err := resolveChannelUploadsPlaylist(url)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to resolve channel: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	client := youtube.Client{HTTPClient: httpClient}
+	playlist, err := client.GetPlaylistContext(r.Context(), uploadsPlaylistID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load channel uploads: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	videoIDs := make([]string, 0, len(playlist.Videos))
+	for _, entry := range playlist.Videos {
+		videoIDs = append(videoIDs, entry.ID)
+	}
+
+	startBatchDownload(w, url, "channel", videoIDs)
+}
+
+// addDownloadURLs replaces job's on-disk OutputFile/ZipFile paths with
+// fetchable ZipURL/DownloadURL fields, so /jobs/{id} responses carry
+// download links instead of leaking internal server file paths. OutputFile
+// and ZipFile are tagged for persistence (the job store round-trips
+// batchJob through JSON), so the API response has to scrub them itself
+// rather than relying on a struct tag.
+func addDownloadURLs(job *batchJob) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.ZipFile != "" {
+		job.ZipURL = fmt.Sprintf("/jobs/%s/download", job.ID)
+		job.ZipFile = ""
+	}
+	for _, vj := range job.Videos {
+		if vj.Status == videoDone && vj.OutputFile != "" {
+			vj.DownloadURL = fmt.Sprintf("/jobs/%s/videos/%s/download", job.ID, vj.VideoID)
+			vj.OutputFile = ""
+		}
+	}
+}
+
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if id == "" {
+		http.Error(w, "Missing job id", http.StatusBadRequest)
+		return
+	}
+
+	job, err := jobs.load(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load job: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "Unknown job id", http.StatusNotFound)
+		return
+	}
+	addDownloadURLs(job)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// jobZipDownloadHandler serves /jobs/{id}/download, handing back the zip
+// archive of every finished video in the batch once runBatchJob has built
+// one.
+func jobZipDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/download")
+	job, err := jobs.load(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load job: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "Unknown job id", http.StatusNotFound)
+		return
+	}
+	if job.ZipFile == "" {
+		http.Error(w, "Job result zip not yet available", http.StatusNotFound)
+		return
+	}
+
+	if err := streamFileToClient(w, r, job.ZipFile, job.ID+".zip", "application/zip"); err != nil {
+		log.Printf("[ERROR] Serving job zip %s: %v", job.ID, err)
+		http.Error(w, "Failed to serve job zip", http.StatusInternalServerError)
+	}
+}
+
+// jobVideoDownloadHandler serves /jobs/{id}/videos/{video_id}/download, for
+// fetching one finished video out of a batch without waiting on the whole
+// job's zip.
+func jobVideoDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/download")
+	parts := strings.SplitN(rest, "/videos/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "Malformed job video download path", http.StatusBadRequest)
+		return
+	}
+	id, videoID := parts[0], parts[1]
+
+	job, err := jobs.load(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load job: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "Unknown job id", http.StatusNotFound)
+		return
+	}
+
+	var vj *videoJob
+	for _, v := range job.Videos {
+		if v.VideoID == videoID {
+			vj = v
+			break
+		}
+	}
+	if vj == nil || vj.Status != videoDone || vj.OutputFile == "" {
+		http.Error(w, "Video not finished or unknown", http.StatusNotFound)
+		return
+	}
+
+	filename := sanitizeFilename(vj.Title) + ".mp4"
+	if err := streamFileToClient(w, r, vj.OutputFile, filename, "video/mp4"); err != nil {
+		log.Printf("[ERROR] Serving job video %s/%s: %v", job.ID, videoID, err)
+		http.Error(w, "Failed to serve video", http.StatusInternalServerError)
+	}
+}
+
+// jobsRouterHandler dispatches requests under /jobs/ to the status,
+// zip-download, or per-video-download handler based on path shape.
+func jobsRouterHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	switch {
+	case strings.Contains(path, "/videos/") && strings.HasSuffix(path, "/download"):
+		jobVideoDownloadHandler(w, r)
+	case strings.HasSuffix(path, "/download"):
+		jobZipDownloadHandler(w, r)
+	default:
+		jobStatusHandler(w, r)
+	}
+}
@@ -13,10 +13,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/kkdai/youtube/v2"
+	"youtube-downloader/ippool"
 )
 
 // Configuration struct
@@ -31,6 +31,8 @@ type Config struct {
 	MaxFileAge      time.Duration `json:"max_file_age"`
 	ServerPort      string        `json:"server_port"`
 	MinDiskSpaceGB  int64         `json:"min_disk_space_gb"`
+	MaxPlaylistSize int           `json:"max_playlist_size"`
+	JobRetention    time.Duration `json:"job_retention"`
 }
 
 // Metrics tracking
@@ -41,9 +43,18 @@ type Metrics struct {
 	TotalBytesServed    int64     `json:"total_bytes_served"`
 	AverageFileSize     float64   `json:"average_file_size"`
 	UptimeStart         time.Time `json:"uptime_start"`
+	ThrottleEvents      int64     `json:"throttle_events"`
 	mutex               sync.RWMutex
 }
 
+// RecordThrottle notes that a source IP was benched after a 429/403 from
+// the YouTube edge, so operators can see throttling trends in /metrics.
+func (m *Metrics) RecordThrottle() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ThrottleEvents++
+}
+
 func (m *Metrics) RecordDownload(success bool, bytes int64) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -77,6 +88,7 @@ func (m *Metrics) GetStats() map[string]interface{} {
 		"total_bytes_served":   m.TotalBytesServed,
 		"average_file_size_mb": m.AverageFileSize / (1024 * 1024),
 		"uptime_hours":         time.Since(m.UptimeStart).Hours(),
+		"throttle_events":      m.ThrottleEvents,
 	}
 }
 
@@ -93,6 +105,8 @@ var (
 		MaxFileAge:      30 * time.Minute,
 		ServerPort:      "7839",
 		MinDiskSpaceGB:  2,
+		MaxPlaylistSize: 50,
+		JobRetention:    2 * time.Hour,
 	}
 
 	metrics           = &Metrics{UptimeStart: time.Now()}
@@ -106,6 +120,13 @@ var (
 			MaxIdleConnsPerHost: 10,
 		},
 	}
+
+	// ipPool rotates outbound source IPs across calls to client.GetStreamContext
+	// to spread load and recover from per-IP throttling; nil when unconfigured.
+	ipPool *ippool.Pool
+
+	// ipThrottleCooldown is how long a source IP is benched after a 429/403.
+	ipThrottleCooldown = 10 * time.Minute
 )
 
 func loadConfigFromEnv() {
@@ -150,56 +171,138 @@ func loadConfigFromEnv() {
 			config.MinDiskSpaceGB = space
 		}
 	}
+
+	if maxPlaylist := os.Getenv("MAX_PLAYLIST_SIZE"); maxPlaylist != "" {
+		if size, err := strconv.Atoi(maxPlaylist); err == nil {
+			config.MaxPlaylistSize = size
+		}
+	}
+
+	if retention := os.Getenv("JOB_RETENTION"); retention != "" {
+		if dur, err := time.ParseDuration(retention); err == nil {
+			config.JobRetention = dur
+		}
+	}
 }
 
-// Get tmpfs usage statistics
-func getTmpfsUsage() (totalMB, usedMB, availableMB float64, usagePercent float64) {
-	var stat syscall.Statfs_t
-	if err := syscall.Statfs(config.TempDir, &stat); err != nil {
-		return 0, 0, 0, 0
+// initIPPool builds the outbound IP pool from SOURCE_IPS if set, otherwise
+// falls back to auto-discovering the host's own non-loopback addresses.
+// Leaving SOURCE_IPS unset and having only one usable address disables
+// rotation: ipPool is then left nil and stream fetches go through httpClient.
+func initIPPool() {
+	if sourceIPs := os.Getenv("SOURCE_IPS"); sourceIPs != "" {
+		ips := strings.Split(sourceIPs, ",")
+		for i := range ips {
+			ips[i] = strings.TrimSpace(ips[i])
+		}
+		ipPool = ippool.New(ips)
+		log.Printf("[INFO] IP pool configured from SOURCE_IPS: %d addresses", ipPool.Len())
+		return
+	}
+
+	pool, err := ippool.Discover()
+	if err != nil {
+		log.Printf("[WARN] Failed to auto-discover source IPs: %v", err)
+		return
 	}
+	if pool.Len() > 1 {
+		ipPool = pool
+		log.Printf("[INFO] IP pool auto-discovered: %d addresses", ipPool.Len())
+	}
+}
 
-	total := stat.Blocks * uint64(stat.Bsize)
-	available := stat.Bavail * uint64(stat.Bsize)
-	used := total - available
+// isThrottleError reports whether err looks like a YouTube edge throttle
+// response (HTTP 429/403), based on the status text the youtube client
+// wraps into its returned errors.
+func isThrottleError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "429") || strings.Contains(msg, "403") ||
+		strings.Contains(msg, "Too Many Requests") || strings.Contains(msg, "Forbidden")
+}
 
-	totalMB = float64(total) / (1024 * 1024)
-	usedMB = float64(used) / (1024 * 1024)
-	availableMB = float64(available) / (1024 * 1024)
-	
-	if total > 0 {
-		usagePercent = float64(used) / float64(total) * 100
+// youtubeClientForStream returns a youtube.Client to use for one
+// GetStreamContext/GetVideoContext call, and the ippool.Lease it was bound
+// to (nil when ipPool is unconfigured). Callers must call lease.Release()
+// once the call (and any following read) is done.
+func youtubeClientForStream() (youtube.Client, *ippool.Lease, error) {
+	if ipPool == nil {
+		return youtube.Client{HTTPClient: httpClient}, nil, nil
 	}
 
-	return totalMB, usedMB, availableMB, usagePercent
+	lease, err := ipPool.Rent()
+	if err != nil {
+		return youtube.Client{}, nil, err
+	}
+
+	client := youtube.Client{HTTPClient: &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: lease.Transport(),
+	}}
+
+	return client, lease, nil
+}
+
+func ipPoolHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if ipPool == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": true,
+		"ips":     ipPool.Snapshot(),
+	})
 }
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.LUTC)
 
 	loadConfigFromEnv()
+	initIPPool()
+	initStorage()
 	downloadSemaphore = make(chan struct{}, config.MaxConcurrent)
 
 	if err := os.MkdirAll(config.TempDir, 0755); err != nil {
 		log.Fatalf("[ERROR] Failed to create temp directory: %v", err)
 	}
 
+	if err := initJobStore(); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
 	if err := checkDiskSpace(config.MinDiskSpaceGB * 1024 * 1024 * 1024); err != nil {
 		log.Fatalf("[ERROR] %v", err)
 	}
 
 	// Log initial tmpfs usage
 	totalMB, usedMB, availableMB, usagePercent := getTmpfsUsage()
-	log.Printf("[INFO] tmpfs Status: %.1fMB total, %.1fMB used (%.1f%%), %.1fMB available", 
+	log.Printf("[INFO] tmpfs Status: %.1fMB total, %.1fMB used (%.1f%%), %.1fMB available",
 		totalMB, usedMB, usagePercent, availableMB)
 
 	go startCleanupRoutine()
 
 	http.HandleFunc("/download", downloadHandler)
+	http.HandleFunc("/download/audio", audioDownloadHandler)
+	http.HandleFunc("/progress", progressHandler)
+	http.HandleFunc("/ippool", ipPoolHandler)
+	http.HandleFunc("/download/playlist", playlistDownloadHandler)
+	http.HandleFunc("/download/channel", channelDownloadHandler)
+	http.HandleFunc("/jobs/", jobsRouterHandler)
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/metrics", metricsHandler)
 	http.HandleFunc("/config", configHandler)
 	http.HandleFunc("/tmpfs", tmpfsHandler)
+	http.HandleFunc("/stream/start", streamStartHandler)
+	http.HandleFunc("/stream/", streamRouterHandler)
 
 	log.Printf("[INFO] YouTube Downloader Server starting on port %s", config.ServerPort)
 	log.Printf("[INFO] Config: Max Quality: %dp, Concurrent: %d, Preset: %s",
@@ -215,26 +318,16 @@ func startCleanupRoutine() {
 	defer ticker.Stop()
 
 	cleanupTempFiles() // Initial cleanup
+	streams.sweepIdle()
+	jobs.reapExpired(config.JobRetention)
 
 	for range ticker.C {
 		cleanupTempFiles()
+		streams.sweepIdle()
+		jobs.reapExpired(config.JobRetention)
 	}
 }
 
-func checkDiskSpace(requiredBytes int64) error {
-	var stat syscall.Statfs_t
-	if err := syscall.Statfs(config.TempDir, &stat); err != nil {
-		return fmt.Errorf("failed to check disk space: %w", err)
-	}
-
-	available := int64(stat.Bavail * uint64(stat.Bsize))
-	if available < requiredBytes {
-		return fmt.Errorf("insufficient disk space: need %.1fGB, have %.1fGB",
-			float64(requiredBytes)/(1024*1024*1024), float64(available)/(1024*1024*1024))
-	}
-	return nil
-}
-
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -278,14 +371,24 @@ func tmpfsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	totalMB, usedMB, availableMB, usagePercent := getTmpfsUsage()
-
-	stats := map[string]interface{}{
-		"tmpfs_total_mb":     totalMB,
-		"tmpfs_used_mb":      usedMB,
-		"tmpfs_available_mb": availableMB,
-		"tmpfs_usage_percent": usagePercent,
-		"is_tmpfs_available": totalMB > 0,
+	var stats map[string]interface{}
+	if !storage.UsesLocalDisk() {
+		stats = map[string]interface{}{
+			"tmpfs_total_mb":      "n/a",
+			"tmpfs_used_mb":       "n/a",
+			"tmpfs_available_mb":  "n/a",
+			"tmpfs_usage_percent": "n/a",
+			"is_tmpfs_available":  false,
+		}
+	} else {
+		totalMB, usedMB, availableMB, usagePercent := getTmpfsUsage()
+		stats = map[string]interface{}{
+			"tmpfs_total_mb":      totalMB,
+			"tmpfs_used_mb":       usedMB,
+			"tmpfs_available_mb":  availableMB,
+			"tmpfs_usage_percent": usagePercent,
+			"is_tmpfs_available":  totalMB > 0,
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -296,7 +399,7 @@ func cleanupTempFiles() {
 	log.Printf("[INFO] Starting cleanup of files older than %v", config.MaxFileAge)
 
 	// Log tmpfs usage before cleanup
-	totalMB, usedMB, availableMB, usagePercent := getTmpfsUsage()
+	_, usedMB, availableMB, usagePercent := getTmpfsUsage()
 	log.Printf("[INFO] tmpfs Before cleanup: %.1fMB used (%.1f%%), %.1fMB available",
 		usedMB, usagePercent, availableMB)
 
@@ -304,7 +407,17 @@ func cleanupTempFiles() {
 	var totalSize int64
 
 	err := filepath.Walk(config.TempDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+		if err != nil {
+			return nil
+		}
+
+		// Batch job output (finished MP4s and the result zip) is kept
+		// advertised at /jobs/{id} long after MaxFileAge would otherwise
+		// sweep it; jobs.reapExpired retires it on the job's own TTL instead.
+		if info.IsDir() && strings.HasPrefix(filepath.Base(path), "batch_") {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
 			return nil
 		}
 
@@ -329,7 +442,7 @@ func cleanupTempFiles() {
 	}
 
 	// Log cleanup results and tmpfs usage after cleanup
-	totalMB, usedMB, availableMB, usagePercent = getTmpfsUsage()
+	_, usedMB, availableMB, usagePercent = getTmpfsUsage()
 	if cleanedCount == 0 {
 		log.Printf("[INFO] Cleanup completed: No files to remove")
 	} else {
@@ -353,6 +466,14 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The download id is returned in the X-Download-ID header for use with
+	// /progress. Response headers are not sent until processing has finished
+	// or failed, so the id is not available to the client while this request
+	// is still blocking.
+	downloadID := fmt.Sprintf("%d", time.Now().UnixNano())
+	hub := registerProgressHub(downloadID)
+	w.Header().Set("X-Download-ID", downloadID)
+
 	// Rate limiting
 	select {
 	case downloadSemaphore <- struct{}{}:
@@ -360,26 +481,28 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	case <-time.After(30 * time.Second):
 		http.Error(w, "Server too busy, try again later", http.StatusServiceUnavailable)
 		metrics.RecordDownload(false, 0)
+		retireProgressHub(downloadID, hub)
 		return
 	}
 
 	// Log tmpfs usage before download
-	totalMB, usedMB, availableMB, usagePercent := getTmpfsUsage()
+	_, usedMB, availableMB, usagePercent := getTmpfsUsage()
 	log.Printf("[INFO] tmpfs Before download: %.1fMB used (%.1f%%), %.1fMB available",
 		usedMB, usagePercent, availableMB)
 
-	log.Printf("[INFO] Processing download: %s", url)
+	log.Printf("[INFO] Processing download: %s (id=%s)", url, downloadID)
 
 	if err := checkDiskSpace(config.MinDiskSpaceGB * 1024 * 1024 * 1024); err != nil {
 		http.Error(w, fmt.Sprintf("Server storage full: %v", err), http.StatusInsufficientStorage)
 		metrics.RecordDownload(false, 0)
+		retireProgressHub(downloadID, hub)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), config.DownloadTimeout)
 	defer cancel()
 
-	outputFile, filename, tempFiles, err := processDownload(ctx, url)
+	outputFile, filename, tempFiles, err := processDownload(ctx, url, downloadID, hub)
 	if err != nil {
 		log.Printf("[ERROR] Download failed: %v", err)
 		cleanupFiles(tempFiles...)
@@ -388,8 +511,10 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		http.Error(w, fmt.Sprintf("Download failed: %v", err), http.StatusInternalServerError)
 		metrics.RecordDownload(false, 0)
+		retireProgressHub(downloadID, hub)
 		return
 	}
+	defer retireProgressHub(downloadID, hub)
 
 	var fileSize int64
 	if stat, err := os.Stat(outputFile); err == nil {
@@ -398,7 +523,7 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		cleanupFiles(append(tempFiles, outputFile)...)
-		
+
 		// Log tmpfs usage after cleanup
 		_, usedMB, availableMB, usagePercent := getTmpfsUsage()
 		log.Printf("[INFO] tmpfs After cleanup: %.1fMB used (%.1f%%), %.1fMB available",
@@ -406,7 +531,24 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[INFO] Cleaned up temp files for: %s", filename)
 	}()
 
-	if err := streamFileToClient(w, outputFile, filename); err != nil {
+	if !storage.UsesLocalDisk() {
+		presignedURL, err := storage.Store(ctx, outputFile, filename)
+		if err != nil {
+			log.Printf("[ERROR] Upload to storage backend failed: %v", err)
+			http.Error(w, fmt.Sprintf("Upload failed: %v", err), http.StatusInternalServerError)
+			metrics.RecordDownload(false, 0)
+			return
+		}
+
+		metrics.RecordDownload(true, fileSize)
+		log.Printf("[INFO] Uploaded to storage backend: %s (%.2f MB)", filename, float64(fileSize)/(1024*1024))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"url": presignedURL, "filename": filename})
+		return
+	}
+
+	if err := streamFileToClient(w, r, outputFile, filename, "video/mp4"); err != nil {
 		log.Printf("[ERROR] Streaming failed: %v", err)
 		metrics.RecordDownload(false, 0)
 	} else {
@@ -415,7 +557,7 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func processDownload(ctx context.Context, url string) (outputFile, filename string, tempFiles []string, err error) {
+func processDownload(ctx context.Context, url, downloadID string, hub *progressHub) (outputFile, filename string, tempFiles []string, err error) {
 	client := youtube.Client{HTTPClient: httpClient}
 
 	video, err := client.GetVideoContext(ctx, url)
@@ -441,7 +583,7 @@ func processDownload(ctx context.Context, url string) (outputFile, filename stri
 		log.Printf("[INFO] Estimated download size: %.2f MB", float64(estimatedSize)/(1024*1024))
 	}
 
-	tempID := fmt.Sprintf("%d", time.Now().UnixNano())
+	tempID := downloadID
 	videoFile := filepath.Join(config.TempDir, fmt.Sprintf("%s_video.tmp", tempID))
 	audioFile := filepath.Join(config.TempDir, fmt.Sprintf("%s_audio.tmp", tempID))
 	outputFile = filepath.Join(config.TempDir, fmt.Sprintf("%s_final.mp4", tempID))
@@ -455,12 +597,12 @@ func processDownload(ctx context.Context, url string) (outputFile, filename stri
 
 	go func() {
 		defer wg.Done()
-		videoErr = downloadStream(ctx, &client, video, bestVideo, videoFile)
+		videoErr = downloadStreamWithProgress(ctx, &client, video, bestVideo, videoFile, hub, "video")
 	}()
 
 	go func() {
 		defer wg.Done()
-		audioErr = downloadStream(ctx, &client, video, bestAudio, audioFile)
+		audioErr = downloadStreamWithProgress(ctx, &client, video, bestAudio, audioFile, hub, "audio")
 	}()
 
 	wg.Wait()
@@ -477,15 +619,20 @@ func processDownload(ctx context.Context, url string) (outputFile, filename stri
 	log.Printf("[INFO] tmpfs During processing: %.1fMB used (%.1f%%), %.1fMB available",
 		usedMB, usagePercent, availableMB)
 
+	hub.publish(progressEvent{Stage: "merge", Percent: 0})
 	if err = mergeStreams(ctx, videoFile, audioFile, outputFile); err != nil {
 		return "", "", tempFiles, fmt.Errorf("merge failed: %w", err)
 	}
+	hub.publish(progressEvent{Stage: "merge", Percent: 100, Done: true})
 
 	filename = sanitizeFilename(video.Title) + ".mp4"
 	return outputFile, filename, tempFiles, nil
 }
 
-func streamFileToClient(w http.ResponseWriter, filepath, filename string) error {
+// streamFileToClient serves filepath to the client as contentType, honoring
+// Range headers via http.ServeContent so browsers can resume or scrub the
+// file before it's fully buffered.
+func streamFileToClient(w http.ResponseWriter, r *http.Request, filepath, filename, contentType string) error {
 	stat, err := os.Stat(filepath)
 	if err != nil {
 		return fmt.Errorf("failed to get file info: %w", err)
@@ -497,12 +644,11 @@ func streamFileToClient(w http.ResponseWriter, filepath, filename string) error
 	}
 	defer file.Close()
 
-	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
 
-	_, err = io.CopyBuffer(w, file, make([]byte, config.BufferSize))
-	return err
+	http.ServeContent(w, r, filename, stat.ModTime(), file)
+	return nil
 }
 
 func cleanupFiles(files ...string) {
@@ -541,13 +687,93 @@ func findBestAudioFormat(formats youtube.FormatList) *youtube.Format {
 }
 
 func downloadStream(ctx context.Context, client *youtube.Client, video *youtube.Video, format *youtube.Format, filename string) error {
-	stream, _, err := client.GetStreamContext(ctx, video, format)
+	return downloadStreamWithProgress(ctx, client, video, format, filename, nil, "")
+}
+
+// downloadStreamWithProgress behaves like downloadStream, but additionally
+// publishes progress events to hub as bytes are read, so callers like
+// processDownload can drive the /progress SSE stream. hub may be nil, in
+// which case this is equivalent to downloadStream. When ipPool is
+// configured, each attempt rents a fresh source IP; a 429/403 benches that
+// IP and retries on another one instead of failing the whole download.
+// fetchStreamToFile truncates filename on every call, so each retry starts
+// the stream clean rather than trying to pick up where the failed attempt
+// left off.
+//
+// This is a conscious tradeoff, not an oversight: a throttle late into a
+// large 1080p/4K file re-downloads everything on the next IP rather than
+// resuming from the last byte. Accepted because fetchStreamToFile has no
+// offset to resume from in the first place (see its doc comment).
+func downloadStreamWithProgress(ctx context.Context, client *youtube.Client, video *youtube.Video, format *youtube.Format, filename string, hub *progressHub, stage string) error {
+	maxAttempts := 1
+	if ipPool != nil {
+		if n := ipPool.Len(); n > maxAttempts {
+			maxAttempts = n
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		attemptClient := client
+		var lease *ippool.Lease
+
+		if ipPool != nil {
+			pooledClient, l, err := youtubeClientForStream()
+			if err != nil {
+				lastErr = err
+				break
+			}
+			attemptClient = &pooledClient
+			lease = l
+		}
+
+		err := fetchStreamToFile(ctx, attemptClient, video, format, filename, hub, stage)
+		if lease != nil {
+			lease.Release()
+		}
+
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if lease == nil || !isThrottleError(err) {
+			return err
+		}
+
+		ipPool.Throttle(lease.IP, ipThrottleCooldown)
+		metrics.RecordThrottle()
+		log.Printf("[WARN] %s download throttled on %s, retrying on a different source IP (attempt %d/%d): %v",
+			stage, lease.IP, attempt+1, maxAttempts, err)
+	}
+
+	return lastErr
+}
+
+// fetchStreamToFile opens the format's stream on client and copies it to
+// filename, publishing progress to hub along the way. kkdai/youtube fetches
+// a format's stream via its own internal parallel chunked requests (keyed
+// off a "range" URL query parameter, not an HTTP Range header) and validates
+// each chunk's exact byte size, so there is no way for a caller to resume a
+// partial fetch from an offset; every call starts the file fresh.
+//
+// Known limitation: this makes downloadStreamWithProgress's retries
+// non-resumable too. There is no caller-side equivalent of "stat the
+// existing temp file and pass Range: bytes=N-" to offer here; closing that
+// gap would require kkdai/youtube itself to expose a resumable fetch.
+func fetchStreamToFile(ctx context.Context, client *youtube.Client, video *youtube.Video, format *youtube.Format, filename string, hub *progressHub, stage string) error {
+	rawStream, _, err := client.GetStreamContext(ctx, video, format)
 	if err != nil {
 		return err
 	}
-	defer stream.Close()
+	defer rawStream.Close()
+
+	var stream io.Reader = rawStream
+	if hub != nil {
+		stream = newProgressReader(rawStream, hub, stage, int64(format.ContentLength))
+	}
 
-	file, err := os.Create(filename)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
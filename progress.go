@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// progressEvent is one JSON frame emitted over the /progress SSE stream.
+type progressEvent struct {
+	Stage   string  `json:"stage"` // "video" | "audio" | "merge"
+	Bytes   int64   `json:"bytes"`
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+	Done    bool    `json:"done,omitempty"`
+}
+
+// progressHub fans out progress events for a single download id to any
+// number of SSE subscribers, and remembers the latest event per stage so a
+// client connecting late still sees current state.
+type progressHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan progressEvent]struct{}
+	last        map[string]progressEvent
+	closed      bool
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{
+		subscribers: make(map[chan progressEvent]struct{}),
+		last:        make(map[string]progressEvent),
+	}
+}
+
+func (h *progressHub) publish(evt progressEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.last[evt.Stage] = evt
+	for ch := range h.subscribers {
+		select {
+		case ch <- evt:
+		default:
+			// Slow subscriber; drop the frame rather than block the download.
+		}
+	}
+}
+
+func (h *progressHub) subscribe() chan progressEvent {
+	ch := make(chan progressEvent, 16)
+	h.mutex.Lock()
+	for _, evt := range h.last {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+	h.subscribers[ch] = struct{}{}
+	h.mutex.Unlock()
+	return ch
+}
+
+func (h *progressHub) unsubscribe(ch chan progressEvent) {
+	h.mutex.Lock()
+	delete(h.subscribers, ch)
+	h.mutex.Unlock()
+}
+
+func (h *progressHub) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.closed = true
+	for ch := range h.subscribers {
+		close(ch)
+	}
+	h.subscribers = nil
+}
+
+// progressHubs is the registry of in-flight downloads, keyed by download id.
+var progressHubs = struct {
+	mutex sync.Mutex
+	hubs  map[string]*progressHub
+}{hubs: make(map[string]*progressHub)}
+
+func registerProgressHub(downloadID string) *progressHub {
+	hub := newProgressHub()
+	progressHubs.mutex.Lock()
+	progressHubs.hubs[downloadID] = hub
+	progressHubs.mutex.Unlock()
+	return hub
+}
+
+func getProgressHub(downloadID string) *progressHub {
+	progressHubs.mutex.Lock()
+	defer progressHubs.mutex.Unlock()
+	return progressHubs.hubs[downloadID]
+}
+
+// retireProgressHub closes the hub and drops it from the registry a short
+// while after the download finishes, giving slow SSE clients a chance to
+// observe the final event.
+func retireProgressHub(downloadID string, hub *progressHub) {
+	time.AfterFunc(30*time.Second, func() {
+		progressHubs.mutex.Lock()
+		delete(progressHubs.hubs, downloadID)
+		progressHubs.mutex.Unlock()
+		hub.close()
+	})
+}
+
+// progressReader wraps an io.Reader, publishing a progress event to hub for
+// every chunk read so downloadStream's existing copy loop doubles as the
+// source of truth for percent-complete.
+type progressReader struct {
+	io.Reader
+	hub   *progressHub
+	stage string
+	total int64
+	read  int64
+}
+
+func newProgressReader(r io.Reader, hub *progressHub, stage string, total int64) *progressReader {
+	return &progressReader{Reader: r, hub: hub, stage: stage, total: total}
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.Reader.Read(buf)
+	if n > 0 {
+		p.read += int64(n)
+		if p.hub != nil {
+			percent := float64(0)
+			if p.total > 0 {
+				percent = float64(p.read) / float64(p.total) * 100
+			}
+			p.hub.publish(progressEvent{
+				Stage:   p.stage,
+				Bytes:   p.read,
+				Total:   p.total,
+				Percent: percent,
+			})
+		}
+	}
+	return n, err
+}
+
+// progressHandler serves /progress?id=<download_id> as an SSE stream of
+// JSON progress frames until the hub is retired or the client disconnects.
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing required parameter: id", http.StatusBadRequest)
+		return
+	}
+
+	hub := getProgressHub(id)
+	if hub == nil {
+		http.Error(w, "Unknown download id", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := hub.subscribe()
+	defer hub.unsubscribe(ch)
+
+	for {
+		select {
+		case evt, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(evt)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
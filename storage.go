@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3PartSize is the chunk size used for multipart uploads; S3 requires
+// every part but the last to be at least 5MB.
+const s3PartSize = 16 * 1024 * 1024
+
+// presignExpiry controls how long a pre-signed download URL stays valid.
+const presignExpiry = 1 * time.Hour
+
+// Storage abstracts where a finished download ends up. The local backend
+// is today's behavior (leave it on tmpfs and stream it to the client); the
+// S3 backend uploads it to an S3-compatible bucket and hands back a
+// pre-signed URL instead, so the client no longer needs to pull the file
+// through this service's own disk/bandwidth. It doesn't remove local disk
+// from the picture entirely: the source streams and ffmpeg's merged output
+// still land on tmpfs first, since Store only runs after processDownload
+// has a finished file to open and upload (see s3Storage.Store).
+type Storage interface {
+	// Store uploads localPath under key and returns a URL the client can
+	// fetch it from. Local storage returns "" since the caller streams the
+	// file itself.
+	Store(ctx context.Context, localPath, key string) (url string, err error)
+	// UsesLocalDisk reports whether tmpfs/disk-space checks are meaningful
+	// for this backend.
+	UsesLocalDisk() bool
+}
+
+// localStorage is the original tmpfs-only behavior: the file stays where
+// processDownload wrote it and downloadHandler streams it directly.
+type localStorage struct{}
+
+func (localStorage) Store(ctx context.Context, localPath, key string) (string, error) {
+	return "", nil
+}
+
+func (localStorage) UsesLocalDisk() bool { return true }
+
+// s3Storage uploads finished downloads to an S3-compatible bucket via a
+// multipart upload and serves them back through a pre-signed URL.
+type s3Storage struct {
+	bucket  string
+	client  *s3.Client
+	presign *s3.PresignClient
+}
+
+// newS3Storage builds an s3Storage from STORAGE_BACKEND=s3's companion env
+// vars: S3_BUCKET (required), S3_ENDPOINT (optional, for S3-compatible
+// services like MinIO/R2/GCS-via-S3-interop), and S3_REGION (defaults to
+// us-east-1).
+func newS3Storage(ctx context.Context) (*s3Storage, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required when STORAGE_BACKEND=s3")
+	}
+
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(region)}
+	if key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); key != "" && secret != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(key, secret, os.Getenv("AWS_SESSION_TOKEN"))))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &s3Storage{
+		bucket:  bucket,
+		client:  client,
+		presign: s3.NewPresignClient(client),
+	}, nil
+}
+
+func (s *s3Storage) UsesLocalDisk() bool { return false }
+
+// Store multipart-uploads localPath to key and returns a pre-signed GET URL
+// valid for presignExpiry. localPath must already be a finished file on
+// disk: ffmpeg merges the source streams into it before processDownload
+// calls Store, so S3 mode still needs tmpfs room for both source streams
+// and the merged output while a download is in progress, not just the
+// bucket itself. It sheds local disk once the upload completes, not before.
+func (s *s3Storage) Store(ctx context.Context, localPath, key string) (string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file for upload: %w", err)
+	}
+	defer file.Close()
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("video/mp4"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	parts, err := s.uploadParts(ctx, file, key, *uploadID)
+	if err != nil {
+		s.abortUpload(ctx, key, *uploadID)
+		return "", err
+	}
+
+	if _, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		s.abortUpload(ctx, key, *uploadID)
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	presigned, err := s.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(presignExpiry))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign download URL: %w", err)
+	}
+
+	return presigned.URL, nil
+}
+
+// uploadParts streams file to S3 in s3PartSize chunks, uploading each part
+// as it's read rather than buffering the whole file in memory.
+func (s *s3Storage) uploadParts(ctx context.Context, file *os.File, key, uploadID string) ([]types.CompletedPart, error) {
+	var parts []types.CompletedPart
+	buffer := make([]byte, s3PartSize)
+
+	for partNumber := int32(1); ; partNumber++ {
+		n, readErr := io.ReadFull(file, buffer)
+		if n == 0 {
+			break
+		}
+
+		result, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			UploadId:      aws.String(uploadID),
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(buffer[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+		}
+
+		parts = append(parts, types.CompletedPart{ETag: result.ETag, PartNumber: aws.Int32(partNumber)})
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read part %d: %w", partNumber, readErr)
+		}
+	}
+
+	return parts, nil
+}
+
+func (s *s3Storage) abortUpload(ctx context.Context, key, uploadID string) {
+	if _, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}); err != nil {
+		log.Printf("[WARN] Failed to abort multipart upload for %s: %v", key, err)
+	}
+}
+
+// storage is the active backend, selected by initStorage based on
+// STORAGE_BACKEND. Defaults to localStorage.
+var storage Storage = localStorage{}
+
+// initStorage switches to the S3 backend when STORAGE_BACKEND=s3, falling
+// back to local tmpfs delivery (and logging why) if that fails.
+func initStorage() {
+	if os.Getenv("STORAGE_BACKEND") != "s3" {
+		return
+	}
+
+	s3Backend, err := newS3Storage(context.Background())
+	if err != nil {
+		log.Printf("[WARN] Failed to initialize S3 storage backend, falling back to local tmpfs: %v", err)
+		return
+	}
+
+	storage = s3Backend
+	log.Printf("[INFO] Storage backend: s3 (bucket=%s)", s3Backend.bucket)
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// variant describes one rung of the adaptive bitrate ladder.
+type variant struct {
+	Quality string
+	Height  int
+	Bitrate int // bits/sec, target output bitrate
+}
+
+// ladder is the full set of renditions we are willing to produce; rungs
+// above the source resolution are skipped when building a session.
+var ladder = []variant{
+	{Quality: "360p", Height: 360, Bitrate: 800_000},
+	{Quality: "480p", Height: 480, Bitrate: 1_400_000},
+	{Quality: "720p", Height: 720, Bitrate: 2_800_000},
+	{Quality: "1080p", Height: 1080, Bitrate: 5_000_000},
+}
+
+const chunkSize = 6 * time.Second
+
+// streamSession tracks the state needed to transcode chunks of one video
+// on demand for HLS playback.
+type streamSession struct {
+	id         string
+	video      *youtube.Video
+	bestVideo  *youtube.Format
+	bestAudio  *youtube.Format
+	duration   time.Duration
+	numChunks  int
+	streams    map[string]variant // quality -> variant
+	dir        string
+	sourceFile string // muxed source used as ffmpeg input for transcodes
+	lastUsed   time.Time
+	inactive   int
+	inflight   map[string]chan struct{} // "quality/chunkIndex" -> closed when its transcode finishes
+	mutex      sync.Mutex
+}
+
+// streamManager owns all active streaming sessions, keyed by session id.
+type streamManager struct {
+	mutex    sync.Mutex
+	sessions map[string]*streamSession
+}
+
+var streams = &streamManager{sessions: make(map[string]*streamSession)}
+
+// segmentKey identifies one cached transcoded segment across every active
+// session.
+type segmentKey struct {
+	sessionID  string
+	videoID    string
+	quality    string
+	chunkIndex int
+}
+
+// segmentEntry tracks an on-disk cached segment for LRU eviction.
+type segmentEntry struct {
+	key      segmentKey
+	path     string
+	lastUsed time.Time
+}
+
+// segmentCache is a process-wide LRU over every session's cached
+// (videoID, quality, chunkIndex) segments, bounded by config.MinDiskSpaceGB
+// so a long-running server serving many sessions doesn't fill the disk with
+// segments nobody is watching anymore. Whole-session cleanup (sweepIdle)
+// still runs separately for sessions that have gone fully idle; this cache
+// additionally reclaims space from live sessions that are simply playing
+// slower than they transcode.
+type segmentCache struct {
+	mutex sync.Mutex
+	order *list.List // front = most recently used
+	elems map[segmentKey]*list.Element
+}
+
+var segments = &segmentCache{order: list.New(), elems: make(map[segmentKey]*list.Element)}
+
+// touch records that key's segment at path was just produced or reused,
+// moving it to the front of the LRU, then evicts least-recently-used
+// segments until free disk space is back above config.MinDiskSpaceGB.
+func (c *segmentCache) touch(key segmentKey, path string) {
+	c.mutex.Lock()
+	if elem, ok := c.elems[key]; ok {
+		elem.Value.(*segmentEntry).lastUsed = time.Now()
+		c.order.MoveToFront(elem)
+	} else {
+		entry := &segmentEntry{key: key, path: path, lastUsed: time.Now()}
+		c.elems[key] = c.order.PushFront(entry)
+	}
+	c.mutex.Unlock()
+
+	c.evictUntilWithinBudget(key)
+}
+
+// evictUntilWithinBudget removes the least-recently-used cached segments
+// (other than keep, the one just touched) until available disk space is at
+// or above config.MinDiskSpaceGB, or there's nothing left to evict.
+func (c *segmentCache) evictUntilWithinBudget(keep segmentKey) {
+	minFreeBytes := config.MinDiskSpaceGB * 1024 * 1024 * 1024
+
+	for {
+		_, _, availableMB, _ := getTmpfsUsage()
+		if int64(availableMB*1024*1024) >= minFreeBytes {
+			return
+		}
+
+		c.mutex.Lock()
+		elem := c.order.Back()
+		for elem != nil && elem.Value.(*segmentEntry).key == keep {
+			elem = elem.Prev()
+		}
+		if elem == nil {
+			c.mutex.Unlock()
+			return
+		}
+		entry := elem.Value.(*segmentEntry)
+		c.order.Remove(elem)
+		delete(c.elems, entry.key)
+		c.mutex.Unlock()
+
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARN] Failed to evict cached segment %s: %v", entry.path, err)
+		}
+		log.Printf("[INFO] Evicted LRU stream segment %s (video=%s quality=%s chunk=%d) to stay under MinDiskSpaceGB=%d",
+			entry.path, entry.key.videoID, entry.key.quality, entry.key.chunkIndex, config.MinDiskSpaceGB)
+	}
+}
+
+// removeSession drops every cache entry belonging to sessionID without
+// unlinking its files, since callers that garbage-collect a whole session
+// already os.RemoveAll its directory.
+func (c *segmentCache) removeSession(sessionID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(*segmentEntry); entry.key.sessionID == sessionID {
+			c.order.Remove(elem)
+			delete(c.elems, entry.key)
+		}
+		elem = next
+	}
+}
+
+func (sm *streamManager) get(id string) *streamSession {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.sessions[id]
+}
+
+func (sm *streamManager) put(s *streamSession) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.sessions[s.id] = s
+}
+
+// sweepIdle drops sessions that have gone untouched for several cleanup
+// cycles and removes their cached segments from TempDir.
+func (sm *streamManager) sweepIdle() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	for id, s := range sm.sessions {
+		s.mutex.Lock()
+		if time.Since(s.lastUsed) > config.MaxFileAge {
+			s.inactive++
+		} else {
+			s.inactive = 0
+		}
+		idle := s.inactive >= 2
+		dir := s.dir
+		s.mutex.Unlock()
+
+		if idle {
+			os.RemoveAll(dir)
+			segments.removeSession(id)
+			delete(sm.sessions, id)
+			log.Printf("[INFO] Stream session %s garbage-collected (idle)", id)
+		}
+	}
+}
+
+// startStreamSession probes the source and prepares a session that serves
+// HLS segments transcoded on demand, instead of a single merged MP4.
+func startStreamSession(ctx context.Context, url string) (*streamSession, error) {
+	client := youtube.Client{HTTPClient: httpClient}
+
+	video, err := client.GetVideoContext(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get video info: %w", err)
+	}
+
+	bestVideo := findBestVideoFormat(video.Formats)
+	bestAudio := findBestAudioFormat(video.Formats)
+	if bestVideo == nil || bestAudio == nil {
+		return nil, fmt.Errorf("could not find required video/audio formats")
+	}
+
+	id := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := filepath.Join(config.TempDir, "stream_"+id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create stream dir: %w", err)
+	}
+
+	videoFile := filepath.Join(dir, "source_video.tmp")
+	audioFile := filepath.Join(dir, "source_audio.tmp")
+	sourceFile := filepath.Join(dir, "source.mp4")
+
+	var wg sync.WaitGroup
+	var videoErr, audioErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		videoErr = downloadStream(ctx, &client, video, bestVideo, videoFile)
+	}()
+	go func() {
+		defer wg.Done()
+		audioErr = downloadStream(ctx, &client, video, bestAudio, audioFile)
+	}()
+	wg.Wait()
+
+	if videoErr != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("video download failed: %w", videoErr)
+	}
+	if audioErr != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("audio download failed: %w", audioErr)
+	}
+
+	if err := mergeStreams(ctx, videoFile, audioFile, sourceFile); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("merge failed: %w", err)
+	}
+	os.Remove(videoFile)
+	os.Remove(audioFile)
+
+	duration, err := probeDuration(ctx, sourceFile)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	streamsByQuality := make(map[string]variant)
+	for _, v := range ladder {
+		if v.Height <= bestVideo.Height {
+			streamsByQuality[v.Quality] = v
+		}
+	}
+	if len(streamsByQuality) == 0 {
+		// Source is lower resolution than our smallest rung; offer that rung
+		// anyway, which the transcode scales up to its height.
+		streamsByQuality[ladder[0].Quality] = ladder[0]
+	}
+
+	numChunks := int((duration + chunkSize - 1) / chunkSize)
+
+	session := &streamSession{
+		id:         id,
+		video:      video,
+		bestVideo:  bestVideo,
+		bestAudio:  bestAudio,
+		duration:   duration,
+		numChunks:  numChunks,
+		streams:    streamsByQuality,
+		dir:        dir,
+		sourceFile: sourceFile,
+		lastUsed:   time.Now(),
+	}
+	streams.put(session)
+
+	log.Printf("[INFO] Started stream session %s for %q (%d chunks, %d qualities)",
+		id, video.Title, numChunks, len(streamsByQuality))
+
+	return session, nil
+}
+
+// probeDuration shells out to ffprobe to read the container duration.
+func probeDuration(ctx context.Context, file string) (time.Duration, error) {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return 0, fmt.Errorf("ffprobe not found in PATH")
+	}
+
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		file,
+	)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse ffprobe duration: %w", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// segmentPath returns the on-disk cache path for a (quality, chunkIndex)
+// pair; it does not create the parent directory (transcodeChunk does).
+func (s *streamSession) segmentPath(quality string, chunkIndex int) string {
+	return filepath.Join(s.dir, quality, fmt.Sprintf("%05d.ts", chunkIndex))
+}
+
+// transcodeChunk renders (and caches) one segment of one quality rung by
+// transcoding the matching window of the merged source file. Concurrent
+// requests for the same (quality, chunkIndex) — routine with HLS players
+// that prefetch, retry, or switch rungs mid-stream — share a single ffmpeg
+// invocation instead of racing to write the same output path: the first
+// caller becomes the "leader" and transcodes, later callers wait on it and
+// then read the result. The leader also renders into a per-attempt temp
+// file and os.Renames it into place, so a reader's cache-hit os.Stat can
+// never observe a partially written segment.
+func (s *streamSession) transcodeChunk(ctx context.Context, quality string, chunkIndex int) (string, error) {
+	v, ok := s.streams[quality]
+	if !ok {
+		return "", fmt.Errorf("unknown quality %q", quality)
+	}
+	if chunkIndex < 0 || chunkIndex >= s.numChunks {
+		return "", fmt.Errorf("chunk %d out of range", chunkIndex)
+	}
+
+	key := segmentKey{sessionID: s.id, videoID: s.video.ID, quality: quality, chunkIndex: chunkIndex}
+	out := s.segmentPath(quality, chunkIndex)
+
+	if _, err := os.Stat(out); err == nil {
+		s.touch()
+		segments.touch(key, out)
+		return out, nil // already cached
+	}
+
+	flightKey := fmt.Sprintf("%s/%d", quality, chunkIndex)
+	done, leader := s.joinFlight(flightKey)
+	if !leader {
+		<-done
+		if _, err := os.Stat(out); err != nil {
+			return "", fmt.Errorf("concurrent transcode of %s chunk %d did not produce a segment", quality, chunkIndex)
+		}
+		s.touch()
+		segments.touch(key, out)
+		return out, nil
+	}
+	defer s.leaveFlight(flightKey, done)
+
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return "", err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", out, time.Now().UnixNano())
+	start := time.Duration(chunkIndex) * chunkSize
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-ss", fmt.Sprintf("%.3f", start.Seconds()),
+		"-i", s.sourceFile,
+		"-t", fmt.Sprintf("%.3f", chunkSize.Seconds()),
+		"-vf", fmt.Sprintf("scale=-2:%d", v.Height),
+		"-c:v", "libx264",
+		"-b:v", fmt.Sprintf("%d", v.Bitrate),
+		"-preset", config.FFmpegPreset,
+		"-c:a", "aac",
+		"-f", "mpegts",
+		"-y",
+		tmp,
+	)
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("ffmpeg transcode failed: %w", err)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to finalize segment: %w", err)
+	}
+
+	s.touch()
+	segments.touch(key, out)
+	return out, nil
+}
+
+// joinFlight registers the caller as interested in flightKey's transcode.
+// If none is running, the caller becomes the leader (responsible for
+// producing the segment and calling leaveFlight when done) and gets a new
+// channel to pass to leaveFlight, and true. Otherwise it gets a channel that closes when the leader
+// finishes, and false.
+func (s *streamSession) joinFlight(flightKey string) (chan struct{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.inflight == nil {
+		s.inflight = make(map[string]chan struct{})
+	}
+	if done, ok := s.inflight[flightKey]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	s.inflight[flightKey] = done
+	return done, true
+}
+
+// leaveFlight releases the leader's claim on flightKey and wakes anyone
+// waiting on done.
+func (s *streamSession) leaveFlight(flightKey string, done chan struct{}) {
+	s.mutex.Lock()
+	delete(s.inflight, flightKey)
+	s.mutex.Unlock()
+	close(done)
+}
+
+func (s *streamSession) touch() {
+	s.mutex.Lock()
+	s.lastUsed = time.Now()
+	s.inactive = 0
+	s.mutex.Unlock()
+}
+
+// writeMasterPlaylist emits a master m3u8 listing each available quality
+// rung as a variant stream pointing at its own media playlist.
+func (s *streamSession) writeMasterPlaylist(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	fmt.Fprintln(bw, "#EXTM3U")
+	fmt.Fprintln(bw, "#EXT-X-VERSION:3")
+	for _, v := range ladder {
+		rung, ok := s.streams[v.Quality]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(bw, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n",
+			rung.Bitrate, rung.Height*16/9, rung.Height)
+		fmt.Fprintf(bw, "%s/playlist.m3u8\n", rung.Quality)
+	}
+}
+
+// writeMediaPlaylist emits the per-quality media playlist referencing each
+// on-demand segment URL.
+func (s *streamSession) writeMediaPlaylist(w http.ResponseWriter, quality string) {
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	fmt.Fprintln(bw, "#EXTM3U")
+	fmt.Fprintln(bw, "#EXT-X-VERSION:3")
+	fmt.Fprintf(bw, "#EXT-X-TARGETDURATION:%d\n", int(chunkSize.Seconds()))
+	fmt.Fprintln(bw, "#EXT-X-PLAYLIST-TYPE:VOD")
+	fmt.Fprintln(bw, "#EXT-X-MEDIA-SEQUENCE:0")
+
+	for i := 0; i < s.numChunks; i++ {
+		segDuration := chunkSize.Seconds()
+		if i == s.numChunks-1 {
+			remainder := s.duration - time.Duration(i)*chunkSize
+			if remainder > 0 {
+				segDuration = remainder.Seconds()
+			}
+		}
+		fmt.Fprintf(bw, "#EXTINF:%.3f,\n", segDuration)
+		fmt.Fprintf(bw, "%05d.ts\n", i)
+	}
+	fmt.Fprintln(bw, "#EXT-X-ENDLIST")
+}
+
+// streamRouterHandler dispatches requests under /stream/ to the master
+// playlist handler or the per-quality segment/playlist handler based on
+// the path shape.
+func streamRouterHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/master.m3u8") {
+		streamMasterHandler(w, r)
+		return
+	}
+	streamSegmentHandler(w, r)
+}
+
+// streamMasterHandler serves /stream/{id}/master.m3u8.
+func streamMasterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/stream/"), "/master.m3u8")
+	session := streams.get(id)
+	if session == nil {
+		http.Error(w, "Unknown stream session", http.StatusNotFound)
+		return
+	}
+	session.touch()
+	session.writeMasterPlaylist(w)
+}
+
+// streamSegmentHandler serves both /stream/{id}/{quality}/playlist.m3u8
+// and /stream/{id}/{quality}/{segment}.ts, transcoding segments on demand.
+func streamSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/stream/"), "/")
+	if len(parts) != 3 {
+		http.Error(w, "Malformed stream path", http.StatusBadRequest)
+		return
+	}
+	id, quality, leaf := parts[0], parts[1], parts[2]
+
+	session := streams.get(id)
+	if session == nil {
+		http.Error(w, "Unknown stream session", http.StatusNotFound)
+		return
+	}
+	session.touch()
+
+	if leaf == "playlist.m3u8" {
+		if _, ok := session.streams[quality]; !ok {
+			http.Error(w, "Unknown quality", http.StatusNotFound)
+			return
+		}
+		session.writeMediaPlaylist(w, quality)
+		return
+	}
+
+	chunkIndex, err := strconv.Atoi(strings.TrimSuffix(leaf, ".ts"))
+	if err != nil {
+		http.Error(w, "Malformed segment name", http.StatusBadRequest)
+		return
+	}
+
+	segPath, err := session.transcodeChunk(r.Context(), quality, chunkIndex)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to produce segment: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeFile(w, r, segPath)
+}
+
+// streamStartHandler kicks off a new HLS session for a video URL and
+// points the caller at its master playlist.
+func streamStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "Missing required parameter: url", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.DownloadTimeout)
+	defer cancel()
+
+	session, err := startStreamSession(ctx, url)
+	if err != nil {
+		log.Printf("[ERROR] Stream session start failed: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to start stream: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":         session.id,
+		"master_url": fmt.Sprintf("/stream/%s/master.m3u8", session.id),
+	})
+}